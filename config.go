@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Module defines the per-target settings used to probe a single plug.
+// Modules are looked up by name through the `module` query parameter
+// of the `/probe` endpoint and carry everything that used to be passed
+// on the command line (password, labels) plus a per-module timeout.
+type Module struct {
+	Password   string            `yaml:"password"`
+	Timeout    time.Duration     `yaml:"timeout"`
+	Labels     map[string]string `yaml:"labels"`
+	Collectors []string          `yaml:"collectors"`
+}
+
+// TargetConfig binds a concrete plug (identified by its target
+// IP/host) to one of the named modules. Request-driven consumers
+// (`/probe`) don't need this - they get target and module from the
+// query string - but subsystems which push data on their own schedule
+// (MQTT bridge, local history) need to know up front which plugs exist.
+type TargetConfig struct {
+	Target string `yaml:"target"`
+	Module string `yaml:"module"`
+}
+
+// Config represents the structure of the YAML configuration file
+type Config struct {
+	Modules map[string]*Module `yaml:"modules"`
+	Targets []TargetConfig     `yaml:"targets"`
+}
+
+// configStore holds the currently active configuration and guards it
+// with a RWMutex so the fsnotify watcher can swap it in while probes
+// are reading from it concurrently.
+type configStore struct {
+	mu  sync.RWMutex
+	cfg *Config
+}
+
+func newConfigStore() *configStore {
+	return &configStore{cfg: &Config{Modules: map[string]*Module{}}}
+}
+
+func (c *configStore) get() *Config {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cfg
+}
+
+func (c *configStore) load(path string) error {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	cfg := &Config{}
+	if err := yaml.Unmarshal(raw, cfg); err != nil {
+		return err
+	}
+
+	if cfg.Modules == nil {
+		cfg.Modules = map[string]*Module{}
+	}
+
+	for _, m := range cfg.Modules {
+		if m.Timeout == 0 {
+			m.Timeout = 5 * time.Second
+		}
+		if m.Password == "" {
+			m.Password = "1234"
+		}
+	}
+
+	c.mu.Lock()
+	c.cfg = cfg
+	c.mu.Unlock()
+
+	return nil
+}
+
+// moduleFor returns the module config for the given name, falling back
+// to a default module (default password, no labels) when the name is
+// empty or unknown so `/probe` keeps working against plugs which were
+// never added to the config file.
+func (c *configStore) moduleFor(name string) *Module {
+	cfg := c.get()
+
+	if m, ok := cfg.Modules[name]; ok {
+		return m
+	}
+
+	return &Module{Password: "1234", Timeout: 5 * time.Second}
+}
+
+// ResolvedTarget pairs a configured target IP with its module settings
+type ResolvedTarget struct {
+	IP     string
+	Module *Module
+}
+
+// ResolvedTargets returns every statically configured target together
+// with the module it was bound to. Used by subsystems which poll
+// plugs on their own schedule instead of being driven by a Prometheus
+// scrape (MQTT bridge, local history).
+func (c *configStore) ResolvedTargets() []ResolvedTarget {
+	cfg := c.get()
+
+	out := make([]ResolvedTarget, 0, len(cfg.Targets))
+	for _, t := range cfg.Targets {
+		out = append(out, ResolvedTarget{IP: t.Target, Module: c.moduleFor(t.Module)})
+	}
+
+	return out
+}
+
+// watchConfig loads the config once and then keeps it in sync with the
+// file on disk using fsnotify, reloading whenever the file is written.
+func watchConfig(path string, store *configStore) error {
+	if err := store.load(path); err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	// Watch the containing directory instead of the file itself so we
+	// also catch editors which replace the file through a rename.
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != filepath.Clean(path) {
+					continue
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+				if err := store.load(path); err != nil {
+					log.Printf("Unable to reload config file '%s': %s", path, err)
+				} else {
+					log.Printf("Reloaded config file '%s'", path)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Config watcher error: %s", err)
+			}
+		}
+	}()
+
+	return nil
+}
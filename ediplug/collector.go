@@ -0,0 +1,314 @@
+package ediplug
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector models a single feature of a plug (state, energy,
+// schedule, ...), mirroring the per-module collector pattern used by
+// ipmi_exporter. Each Collector is built for exactly one plug/scrape
+// and fetches its own data when Collect is called.
+type Collector interface {
+	// Name identifies the collector for the --collectors flag / per-module config
+	Name() string
+	// Describe sends the static metric descriptors emitted by this collector
+	Describe(ch chan<- *prometheus.Desc)
+	// Collect fetches live data from the plug and sends it to ch
+	Collect(ch chan<- prometheus.Metric) error
+}
+
+// CollectorNames lists every collector ediplug_ctrl knows how to run
+var CollectorNames = []string{"system-info", "state", "energy", "schedule", "wifi-info", "energy-history"}
+
+// DefaultCollectorNames is the set of collectors run when neither
+// --collectors nor a module's `collectors` list configure one
+var DefaultCollectorNames = []string{"system-info", "state", "energy"}
+
+// NewCollector builds the named collector for a single plug. info must
+// already be populated (via GetSystemInfoCommand) so collectors can
+// gate metrics on model/firmware, e.g. EnergyCollector skipping older
+// SP-1101W firmware which doesn't report energy at all.
+func NewCollector(name, target, password string, info *GetSystemInfoCommand, labels prometheus.Labels) (Collector, error) {
+	switch name {
+	case "system-info":
+		return &SystemInfoCollector{target: target, password: password, labels: labels}, nil
+	case "state":
+		return &StateCollector{target: target, password: password, labels: labels}, nil
+	case "energy":
+		return &EnergyCollector{target: target, password: password, info: info, labels: labels}, nil
+	case "schedule":
+		return &ScheduleCollector{target: target, password: password, labels: labels}, nil
+	case "wifi-info":
+		return &WiFiInfoCollector{target: target, password: password, labels: labels}, nil
+	case "energy-history":
+		return &EnergyHistoryCollector{target: target, password: password, info: info, labels: labels}, nil
+	default:
+		return nil, fmt.Errorf("unknown collector %q", name)
+	}
+}
+
+// SupportsEnergy reports whether a plug model exposes energy readings.
+// Older SP-1101W firmware has no energy metering hardware at all and
+// would otherwise report misleading zero-valued gauges.
+func SupportsEnergy(model string) bool {
+	switch model {
+	case "SP1101W", "SP-1101W":
+		return false
+	default:
+		return true
+	}
+}
+
+// sortedLabels returns the label names (sorted, for stable Desc
+// ordering) and the matching values of a label set
+func sortedLabels(labels prometheus.Labels) ([]string, []string) {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	values := make([]string, len(names))
+	for i, n := range names {
+		values[i] = labels[n]
+	}
+
+	return names, values
+}
+
+// SystemInfoCollector exposes a constant info metric carrying the
+// plug's model/firmware/mac/name as labels
+type SystemInfoCollector struct {
+	target, password string
+	labels           prometheus.Labels
+}
+
+// Name returns the collector's name
+func (c *SystemInfoCollector) Name() string { return "system-info" }
+
+// Describe sends this collector's metric descriptors
+func (c *SystemInfoCollector) Describe(ch chan<- *prometheus.Desc) {
+	names, _ := sortedLabels(c.labels)
+	ch <- prometheus.NewDesc("ediplug_system_info", "Constant 1, carries plug metadata as labels", names, nil)
+}
+
+// Collect fetches live data and sends it to ch
+func (c *SystemInfoCollector) Collect(ch chan<- prometheus.Metric) error {
+	names, values := sortedLabels(c.labels)
+	desc := prometheus.NewDesc("ediplug_system_info", "Constant 1, carries plug metadata as labels", names, nil)
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, values...)
+	return nil
+}
+
+// StateCollector exposes whether the plug is currently switched on
+type StateCollector struct {
+	target, password string
+	labels           prometheus.Labels
+}
+
+// Name returns the collector's name
+func (c *StateCollector) Name() string { return "state" }
+
+// Describe sends this collector's metric descriptors
+func (c *StateCollector) Describe(ch chan<- *prometheus.Desc) {
+	names, _ := sortedLabels(c.labels)
+	ch <- prometheus.NewDesc("ediplug_activated", "0 if switched off, 1 if switched on", names, nil)
+}
+
+// Collect fetches live data and sends it to ch
+func (c *StateCollector) Collect(ch chan<- prometheus.Metric) error {
+	cs := &GetStateCommand{}
+	if err := ExecuteCommand(cs, c.target, c.password); err != nil {
+		return err
+	}
+
+	var v float64
+	switch cs.CurrentState {
+	case "ON":
+		v = 1
+	case "OFF":
+		v = 0
+	default:
+		return fmt.Errorf("got unexpected activation status: %s", cs.CurrentState)
+	}
+
+	names, values := sortedLabels(c.labels)
+	desc := prometheus.NewDesc("ediplug_activated", "0 if switched off, 1 if switched on", names, nil)
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, values...)
+	return nil
+}
+
+// EnergyCollector exposes the plug's current power draw and its
+// daily/weekly/monthly energy counters
+type EnergyCollector struct {
+	target, password string
+	info             *GetSystemInfoCommand
+	labels           prometheus.Labels
+}
+
+// Name returns the collector's name
+func (c *EnergyCollector) Name() string { return "energy" }
+
+// Describe sends this collector's metric descriptors
+func (c *EnergyCollector) Describe(ch chan<- *prometheus.Desc) {
+	names, _ := sortedLabels(c.labels)
+	for _, m := range c.metrics() {
+		ch <- prometheus.NewDesc(m.name, m.help, names, nil)
+	}
+}
+
+// Collect fetches live data and sends it to ch. Plugs whose firmware
+// doesn't support energy metering are silently skipped instead of
+// emitting zero-valued gauges that look like a real reading.
+func (c *EnergyCollector) Collect(ch chan<- prometheus.Metric) error {
+	if c.info != nil && !SupportsEnergy(c.info.Model) {
+		return nil
+	}
+
+	ce := &GetEnergyCommand{}
+	if err := ExecuteCommand(ce, c.target, c.password); err != nil {
+		return err
+	}
+
+	names, values := sortedLabels(c.labels)
+	for _, m := range c.metricsWithValues(ce) {
+		desc := prometheus.NewDesc(m.name, m.help, names, nil)
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, m.value, values...)
+	}
+
+	return nil
+}
+
+type energyMetric struct {
+	name, help string
+	value      float64
+}
+
+func (c *EnergyCollector) metrics() []energyMetric {
+	return c.metricsWithValues(&GetEnergyCommand{})
+}
+
+func (c *EnergyCollector) metricsWithValues(ce *GetEnergyCommand) []energyMetric {
+	return []energyMetric{
+		{"ediplug_now_current", "Current in Ampere fetched this scrape", ce.NowCurrent},
+		{"ediplug_now_power", "Power in Watt fetched this scrape", ce.NowPower},
+		{"ediplug_daily_energy", "Energy used within last day, measured in kWh", ce.DailyEnergy},
+		{"ediplug_weekly_energy", "Energy used within last week, measured in kWh", ce.WeeklyEnergy},
+		{"ediplug_monthly_energy", "Energy used within last month, measured in kWh", ce.MonthlyEnergy},
+	}
+}
+
+// ScheduleCollector exposes the plug's built-in on/off schedule
+type ScheduleCollector struct {
+	target, password string
+	labels           prometheus.Labels
+}
+
+// Name returns the collector's name
+func (c *ScheduleCollector) Name() string { return "schedule" }
+
+// Describe sends this collector's metric descriptors
+func (c *ScheduleCollector) Describe(ch chan<- *prometheus.Desc) {
+	names, _ := sortedLabels(c.labels)
+	names = append(names, "day", "start_time", "end_time")
+	ch <- prometheus.NewDesc("ediplug_schedule_slot_enabled", "1 if the schedule slot is enabled, 0 otherwise", names, nil)
+}
+
+// Collect fetches live data and sends it to ch
+func (c *ScheduleCollector) Collect(ch chan<- prometheus.Metric) error {
+	cs := &GetScheduleCommand{}
+	if err := ExecuteCommand(cs, c.target, c.password); err != nil {
+		return err
+	}
+
+	names, values := sortedLabels(c.labels)
+	names = append(names, "day", "start_time", "end_time")
+	desc := prometheus.NewDesc("ediplug_schedule_slot_enabled", "1 if the schedule slot is enabled, 0 otherwise", names, nil)
+
+	for _, slot := range cs.Slots {
+		v := 0.0
+		if slot.Enabled {
+			v = 1.0
+		}
+		slotValues := append(append([]string{}, values...), slot.Day, slot.StartTime, slot.EndTime)
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, slotValues...)
+	}
+
+	return nil
+}
+
+// WiFiInfoCollector exposes the plug's WiFi signal strength
+type WiFiInfoCollector struct {
+	target, password string
+	labels           prometheus.Labels
+}
+
+// Name returns the collector's name
+func (c *WiFiInfoCollector) Name() string { return "wifi-info" }
+
+// Describe sends this collector's metric descriptors
+func (c *WiFiInfoCollector) Describe(ch chan<- *prometheus.Desc) {
+	names, _ := sortedLabels(c.labels)
+	names = append(names, "ssid")
+	ch <- prometheus.NewDesc("ediplug_wifi_rssi_dbm", "WiFi signal strength in dBm", names, nil)
+}
+
+// Collect fetches live data and sends it to ch
+func (c *WiFiInfoCollector) Collect(ch chan<- prometheus.Metric) error {
+	cw := &GetWiFiInfoCommand{}
+	if err := ExecuteCommand(cw, c.target, c.password); err != nil {
+		return err
+	}
+
+	names, values := sortedLabels(c.labels)
+	names = append(names, "ssid")
+	values = append(values, cw.SSID)
+
+	desc := prometheus.NewDesc("ediplug_wifi_rssi_dbm", "WiFi signal strength in dBm", names, nil)
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(cw.RSSI), values...)
+	return nil
+}
+
+// EnergyHistoryCollector exposes the plug's per-hour energy history
+// (only available on SP-2101W-class hardware)
+type EnergyHistoryCollector struct {
+	target, password string
+	info             *GetSystemInfoCommand
+	labels           prometheus.Labels
+}
+
+// Name returns the collector's name
+func (c *EnergyHistoryCollector) Name() string { return "energy-history" }
+
+// Describe sends this collector's metric descriptors
+func (c *EnergyHistoryCollector) Describe(ch chan<- *prometheus.Desc) {
+	names, _ := sortedLabels(c.labels)
+	names = append(names, "hour")
+	ch <- prometheus.NewDesc("ediplug_energy_hour_kwh", "Energy used during the given hour of the day, measured in kWh", names, nil)
+}
+
+// Collect fetches live data and sends it to ch
+func (c *EnergyHistoryCollector) Collect(ch chan<- prometheus.Metric) error {
+	if c.info != nil && !SupportsEnergy(c.info.Model) {
+		return nil
+	}
+
+	ch2 := &GetHistoricalEnergyCommand{}
+	if err := ExecuteCommand(ch2, c.target, c.password); err != nil {
+		return err
+	}
+
+	names, values := sortedLabels(c.labels)
+	names = append(names, "hour")
+	desc := prometheus.NewDesc("ediplug_energy_hour_kwh", "Energy used during the given hour of the day, measured in kWh", names, nil)
+
+	for _, h := range ch2.Hours {
+		hourValues := append(append([]string{}, values...), fmt.Sprintf("%d", h.Hour))
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, h.EnergyKWh, hourValues...)
+	}
+
+	return nil
+}
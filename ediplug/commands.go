@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"golang.org/x/net/html/charset"
@@ -222,3 +224,170 @@ func (g *GetSystemInfoCommand) Parse(in io.Reader) error {
 
 	return nil
 }
+
+// ScheduleSlot is a single on/off slot of the plug's built-in schedule
+type ScheduleSlot struct {
+	Day       string
+	StartTime string
+	EndTime   string
+	Enabled   bool
+}
+
+// GetScheduleCommand retrieves the plug's built-in SCHEDULE block
+type GetScheduleCommand struct {
+	Slots []ScheduleSlot
+
+	comm struct {
+		XMLName xml.Name `xml:"SMARTPLUG"`
+		ID      string   `xml:"id,attr"`
+		Command struct {
+			ID       string `xml:"id,attr"`
+			Schedule struct {
+				State string `xml:"Device.System.Power.Schedule.State,omitempty"`
+				Value string `xml:"Device.System.Power.Schedule.Value,omitempty"`
+			} `xml:"SCHEDULE"`
+		} `xml:"CMD"`
+	}
+}
+
+// GetXML assembles the request XML
+func (g *GetScheduleCommand) GetXML() ([]byte, error) {
+	g.comm.ID = "edimax"
+	g.comm.Command.ID = "get"
+
+	return xml.Marshal(g.comm)
+}
+
+// Parse parses data from the response XML. The plug encodes its
+// schedule as a ';'-separated list of "day,start,end,enabled" slots in
+// the Value field.
+func (g *GetScheduleCommand) Parse(in io.Reader) error {
+	decoder := xml.NewDecoder(in)
+	decoder.CharsetReader = charset.NewReaderLabel
+	if err := decoder.Decode(&g.comm); err != nil {
+		return err
+	}
+
+	if g.comm.Command.Schedule.Value == "" {
+		return nil
+	}
+
+	for _, raw := range strings.Split(g.comm.Command.Schedule.Value, ";") {
+		parts := strings.Split(raw, ",")
+		if len(parts) != 4 {
+			continue
+		}
+
+		g.Slots = append(g.Slots, ScheduleSlot{
+			Day:       parts[0],
+			StartTime: parts[1],
+			EndTime:   parts[2],
+			Enabled:   parts[3] == "1",
+		})
+	}
+
+	return nil
+}
+
+// GetWiFiInfoCommand retrieves the plug's current WiFi connection info
+type GetWiFiInfoCommand struct {
+	SSID string
+	RSSI int // Measured in dBm
+
+	comm struct {
+		XMLName xml.Name `xml:"SMARTPLUG"`
+		ID      string   `xml:"id,attr"`
+		Command struct {
+			ID   string `xml:"id,attr"`
+			WiFi struct {
+				SSID string `xml:"Device.WiFi.SSID,omitempty"`
+				RSSI string `xml:"Device.WiFi.RSSI,omitempty"`
+			} `xml:"WIFI_INFO"`
+		} `xml:"CMD"`
+	}
+}
+
+// GetXML assembles the request XML
+func (g *GetWiFiInfoCommand) GetXML() ([]byte, error) {
+	g.comm.ID = "edimax"
+	g.comm.Command.ID = "get"
+
+	return xml.Marshal(g.comm)
+}
+
+// Parse parses data from the response XML
+func (g *GetWiFiInfoCommand) Parse(in io.Reader) error {
+	decoder := xml.NewDecoder(in)
+	decoder.CharsetReader = charset.NewReaderLabel
+	if err := decoder.Decode(&g.comm); err != nil {
+		return err
+	}
+
+	g.SSID = g.comm.Command.WiFi.SSID
+
+	if g.comm.Command.WiFi.RSSI != "" {
+		rssi, err := strconv.Atoi(g.comm.Command.WiFi.RSSI)
+		if err != nil {
+			return err
+		}
+		g.RSSI = rssi
+	}
+
+	return nil
+}
+
+// HourlyEnergy is the energy used during a single hour of the day
+type HourlyEnergy struct {
+	Hour      int
+	EnergyKWh float64
+}
+
+// GetHistoricalEnergyCommand retrieves the per-hour energy history kept
+// by SP-2101W plugs. Plugs without this capability (e.g. SP-1101W)
+// return an empty history.
+type GetHistoricalEnergyCommand struct {
+	Hours []HourlyEnergy
+
+	comm struct {
+		XMLName xml.Name `xml:"SMARTPLUG"`
+		ID      string   `xml:"id,attr"`
+		Command struct {
+			ID       string `xml:"id,attr"`
+			NowPower struct {
+				History string `xml:"Device.System.Power.NowEnergy.History,omitempty"`
+			} `xml:"NOW_POWER"`
+		} `xml:"CMD"`
+	}
+}
+
+// GetXML assembles the request XML
+func (g *GetHistoricalEnergyCommand) GetXML() ([]byte, error) {
+	g.comm.ID = "edimax"
+	g.comm.Command.ID = "get"
+
+	return xml.Marshal(g.comm)
+}
+
+// Parse parses data from the response XML. History is encoded as a
+// comma-separated list of up to 24 hourly kWh values, oldest hour first.
+func (g *GetHistoricalEnergyCommand) Parse(in io.Reader) error {
+	decoder := xml.NewDecoder(in)
+	decoder.CharsetReader = charset.NewReaderLabel
+	if err := decoder.Decode(&g.comm); err != nil {
+		return err
+	}
+
+	if g.comm.Command.NowPower.History == "" {
+		return nil
+	}
+
+	for i, raw := range strings.Split(g.comm.Command.NowPower.History, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil {
+			return err
+		}
+		g.Hours = append(g.Hours, HourlyEnergy{Hour: i, EnergyKWh: v})
+	}
+
+	return nil
+}
@@ -0,0 +1,226 @@
+// Package discovery implements UPnP/SSDP auto-discovery of Edimax
+// SmartPlug devices on the local network, so a multi-target exporter
+// does not need a static list of IPs configured up front.
+package discovery
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/ediplug_ctrl/ediplug"
+)
+
+const (
+	ssdpAddress = "239.255.255.250:1900"
+
+	searchTargetEdimax = "urn:edimax-com:device:SmartPlug:1"
+	searchTargetAll    = "ssdp:all"
+
+	// maxFailedProbes is the number of consecutive failed probes after
+	// which a previously discovered target is considered gone and
+	// removed from the discovery set again.
+	maxFailedProbes = 3
+)
+
+// Target is a single discovered (and confirmed) Edimax plug
+type Target struct {
+	IP          string
+	SystemName  string
+	MacAddress  string
+	failedCount int
+}
+
+// Discoverer periodically searches the network for Edimax plugs via
+// SSDP and keeps track of which ones are currently reachable
+type Discoverer struct {
+	password string
+	interval time.Duration
+
+	mu      sync.RWMutex
+	targets map[string]*Target
+}
+
+// New creates a Discoverer which confirms candidates using the given
+// plug password and re-runs its SSDP sweep at the given interval
+func New(password string, interval time.Duration) *Discoverer {
+	return &Discoverer{
+		password: password,
+		interval: interval,
+		targets:  map[string]*Target{},
+	}
+}
+
+// Start launches the periodic discovery sweep in the background. It
+// returns immediately; call it once during startup
+func (d *Discoverer) Start() {
+	go func() {
+		for {
+			if err := d.sweep(); err != nil {
+				log.Printf("Discovery sweep failed: %s", err)
+			}
+			time.Sleep(d.interval)
+		}
+	}()
+}
+
+// Targets returns a snapshot of the currently known, confirmed plugs
+func (d *Discoverer) Targets() []Target {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	out := make([]Target, 0, len(d.targets))
+	for _, t := range d.targets {
+		out = append(out, *t)
+	}
+	return out
+}
+
+// RecordFailure marks a probe against the given IP as failed. After
+// maxFailedProbes consecutive failures the target is forgotten and
+// will have to be re-discovered before it is probed again
+func (d *Discoverer) RecordFailure(ip string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, ok := d.targets[ip]
+	if !ok {
+		return
+	}
+
+	t.failedCount++
+	if t.failedCount >= maxFailedProbes {
+		log.Printf("Discovery: forgetting unreachable plug %s", ip)
+		delete(d.targets, ip)
+	}
+}
+
+// RecordSuccess resets the failure counter for a known target
+func (d *Discoverer) RecordSuccess(ip string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if t, ok := d.targets[ip]; ok {
+		t.failedCount = 0
+	}
+}
+
+// sweep issues M-SEARCH multicasts on every IPv4 interface and
+// confirms every responding IP is really an Edimax plug
+func (d *Discoverer) sweep() error {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+
+	candidates := map[string]struct{}{}
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagMulticast == 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+
+		for _, st := range []string{searchTargetEdimax, searchTargetAll} {
+			ips, err := search(iface, st)
+			if err != nil {
+				continue
+			}
+			for _, ip := range ips {
+				candidates[ip] = struct{}{}
+			}
+		}
+	}
+
+	for ip := range candidates {
+		d.confirm(ip)
+	}
+
+	return nil
+}
+
+// confirm probes a candidate IP with GetSystemInfoCommand to make sure
+// it is actually an Edimax SmartPlug before adding it to the target set
+func (d *Discoverer) confirm(ip string) {
+	c := &ediplug.GetSystemInfoCommand{}
+	if err := ediplug.ExecuteCommand(c, ip, d.password); err != nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.targets[ip] = &Target{
+		IP:         ip,
+		SystemName: c.SystemName,
+		MacAddress: c.MacAddress,
+	}
+}
+
+// search sends a single M-SEARCH request on the given interface and
+// collects the IPs of devices which responded within the timeout
+func search(iface net.Interface, searchTarget string) ([]string, error) {
+	addr, err := net.ResolveUDPAddr("udp4", ssdpAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", &iface, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	req := fmt.Sprintf("M-SEARCH * HTTP/1.1\r\n"+
+		"HOST: %s\r\n"+
+		"MAN: \"ssdp:discover\"\r\n"+
+		"MX: 2\r\n"+
+		"ST: %s\r\n\r\n", ssdpAddress, searchTarget)
+
+	if _, err := conn.WriteTo([]byte(req), addr); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	var ips []string
+	buf := make([]byte, 2048)
+	for {
+		n, raddr, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+
+		if !looksLikeSSDPResponse(buf[:n]) {
+			continue
+		}
+
+		if host, _, err := net.SplitHostPort(raddr.String()); err == nil {
+			ips = append(ips, host)
+		}
+	}
+
+	return ips, nil
+}
+
+// looksLikeSSDPResponse does a cheap sanity check on the response so
+// we don't treat arbitrary multicast noise as a discovery hit
+func looksLikeSSDPResponse(data []byte) bool {
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	if !scanner.Scan() {
+		return false
+	}
+	return strings.HasPrefix(scanner.Text(), "HTTP/1.1 200")
+}
+
+// HTTPSDTarget returns the value to put in a Prometheus http_sd_config
+// response's `targets` list. It's the bare IP, not "ip:10000": /probe's
+// `target` query parameter is passed straight into ediplug.ExecuteCommand,
+// which appends the plug's fixed port itself, so the two stay compatible
+// the same way blackbox_exporter passes __address__ through unmodified.
+func (t Target) HTTPSDTarget() string {
+	return t.IP
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/ediplug_ctrl/ediplug"
+	"github.com/Luzifer/ediplug_ctrl/history"
+)
+
+// sessionBaseline is the per-plug state sessionTracker needs to turn
+// the daily energy counter into "energy used since the plug was last
+// switched ON".
+type sessionBaseline struct {
+	toggleTime time.Time
+
+	dayStartDaily float64 // daily-counter reading to subtract for the day currently in progress
+	lastDaily     float64 // most recent daily-counter reading, used to detect a midnight rollover
+	accumulated   float64 // energy totalled from full days already completed this session
+}
+
+// sessionTracker approximates "energy used since the plug was last
+// switched ON" from the daily energy counter, since that's the
+// smallest rolling counter the plug itself exposes. It resets its
+// baseline whenever LastToggleTime moves. Because the baseline rides
+// on the daily counter, a session spanning local midnight sees that
+// counter reset to (near) zero mid-session; sessionEnergy detects the
+// reset, folds the day that just ended into `accumulated`, and starts
+// counting the new day from its own zero instead of subtracting across
+// the reset (which would go negative) or just restarting from zero
+// (which would silently drop everything counted before the reset).
+type sessionTracker struct {
+	mu       sync.Mutex
+	baseline map[string]sessionBaseline
+}
+
+func newSessionTracker() *sessionTracker {
+	return &sessionTracker{baseline: map[string]sessionBaseline{}}
+}
+
+func (t *sessionTracker) sessionEnergy(mac string, toggleTime time.Time, dailyEnergy float64) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b, ok := t.baseline[mac]
+	if !ok || !b.toggleTime.Equal(toggleTime) {
+		b = sessionBaseline{toggleTime: toggleTime, dayStartDaily: dailyEnergy, lastDaily: dailyEnergy}
+		t.baseline[mac] = b
+		return 0
+	}
+
+	if dailyEnergy < b.lastDaily {
+		// The daily counter rolled over (local midnight): fold the day
+		// that just ended into `accumulated` and count the new day from
+		// its own zero rather than this session's original baseline.
+		b.accumulated += b.lastDaily - b.dayStartDaily
+		b.dayStartDaily = 0
+	}
+	b.lastDaily = dailyEnergy
+	t.baseline[mac] = b
+
+	return b.accumulated + dailyEnergy - b.dayStartDaily
+}
+
+// runHistoryPoller periodically snapshots every statically configured
+// target into the history store. It never returns; call it with `go`.
+func runHistoryPoller(store *history.Store, interval time.Duration) {
+	sessions := newSessionTracker()
+
+	for {
+		for _, t := range modules.ResolvedTargets() {
+			if err := pollHistoryOnce(store, sessions, t.IP, t.Module.Password); err != nil {
+				log.Printf("History: unable to poll plug '%s': %s", t.IP, err)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func pollHistoryOnce(store *history.Store, sessions *sessionTracker, target, password string) error {
+	si := &ediplug.GetSystemInfoCommand{}
+	if err := ediplug.ExecuteCommand(si, target, password); err != nil {
+		return err
+	}
+
+	sample := history.Sample{Timestamp: time.Now()}
+
+	// Older SP-1101W firmware has no energy metering hardware at all;
+	// GetEnergyCommand.Parse hard-fails on its empty LastToggleTime, so
+	// skip it rather than letting that void the whole poll (we'd then
+	// record nothing at all, not even a point confirming it's online).
+	if ediplug.SupportsEnergy(si.Model) {
+		ce := &ediplug.GetEnergyCommand{}
+		if err := ediplug.ExecuteCommand(ce, target, password); err != nil {
+			return err
+		}
+
+		sample.NowPower = ce.NowPower
+		sample.NowCurrent = ce.NowCurrent
+		sample.DailyEnergy = ce.DailyEnergy
+		sample.WeeklyEnergy = ce.WeeklyEnergy
+		sample.MonthlyEnergy = ce.MonthlyEnergy
+		sample.SessionEnergy = sessions.sessionEnergy(si.SystemName, ce.LastToggleTime, ce.DailyEnergy)
+	}
+
+	return store.Record(si.SystemName, sample)
+}
+
+// handleHistory serves recorded samples for a plug as JSON (default)
+// or CSV (?format=csv), identified by its friendly system name via
+// ?system= (the same name used in MQTT topics, /discovery labels and
+// /rules). An optional ?step=<dur> downsamples the result, averaging
+// NowPower/NowCurrent and keeping the last energy counters per bucket.
+func handleHistory(historyStore *history.Store) http.HandlerFunc {
+	return func(res http.ResponseWriter, r *http.Request) {
+		if historyStore == nil {
+			http.Error(res, "history is not enabled", http.StatusNotFound)
+			return
+		}
+
+		system := r.URL.Query().Get("system")
+		if system == "" {
+			http.Error(res, "system parameter is required", http.StatusBadRequest)
+			return
+		}
+
+		from, err := parseUnixOrDefault(r.URL.Query().Get("from"), time.Now().Add(-24*time.Hour))
+		if err != nil {
+			http.Error(res, fmt.Sprintf("invalid from: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		to, err := parseUnixOrDefault(r.URL.Query().Get("to"), time.Now())
+		if err != nil {
+			http.Error(res, fmt.Sprintf("invalid to: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		var step time.Duration
+		if raw := r.URL.Query().Get("step"); raw != "" {
+			step, err = time.ParseDuration(raw)
+			if err != nil {
+				http.Error(res, fmt.Sprintf("invalid step: %s", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		samples, err := historyStore.Query(system, from, to)
+		if err != nil {
+			http.Error(res, fmt.Sprintf("unable to query history: %s", err), http.StatusInternalServerError)
+			return
+		}
+
+		samples = downsample(samples, step)
+
+		if r.URL.Query().Get("format") == "csv" {
+			writeHistoryCSV(res, samples)
+			return
+		}
+
+		writeHistoryJSON(res, samples)
+	}
+}
+
+// downsample groups chronologically-ordered samples into step-sized
+// buckets, averaging the instantaneous readings (NowPower/NowCurrent)
+// and keeping the last (i.e. newest) value of the cumulative counters
+// per bucket. A non-positive step disables downsampling.
+func downsample(samples []history.Sample, step time.Duration) []history.Sample {
+	if step <= 0 || len(samples) == 0 {
+		return samples
+	}
+
+	var (
+		out         []history.Sample
+		bucketStart time.Time
+		acc         history.Sample
+		count       int
+	)
+
+	flush := func() {
+		if count == 0 {
+			return
+		}
+		acc.Timestamp = bucketStart
+		acc.NowPower /= float64(count)
+		acc.NowCurrent /= float64(count)
+		out = append(out, acc)
+	}
+
+	for _, s := range samples {
+		start := s.Timestamp.Truncate(step)
+		if count == 0 || !start.Equal(bucketStart) {
+			flush()
+			bucketStart = start
+			acc = history.Sample{}
+			count = 0
+		}
+
+		acc.NowPower += s.NowPower
+		acc.NowCurrent += s.NowCurrent
+		acc.DailyEnergy = s.DailyEnergy
+		acc.WeeklyEnergy = s.WeeklyEnergy
+		acc.MonthlyEnergy = s.MonthlyEnergy
+		acc.SessionEnergy = s.SessionEnergy
+		count++
+	}
+	flush()
+
+	return out
+}
+
+func parseUnixOrDefault(raw string, def time.Time) (time.Time, error) {
+	if raw == "" {
+		return def, nil
+	}
+
+	ts, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(ts, 0), nil
+}
+
+func writeHistoryJSON(res http.ResponseWriter, samples []history.Sample) {
+	res.Header().Set("Content-Type", "application/json")
+	if samples == nil {
+		samples = []history.Sample{}
+	}
+	json.NewEncoder(res).Encode(samples)
+}
+
+func writeHistoryCSV(res http.ResponseWriter, samples []history.Sample) {
+	res.Header().Set("Content-Type", "text/csv")
+
+	w := csv.NewWriter(res)
+	defer w.Flush()
+
+	w.Write([]string{"timestamp", "now_power", "now_current", "daily_energy", "weekly_energy", "monthly_energy", "session_energy"})
+	for _, s := range samples {
+		w.Write([]string{
+			s.Timestamp.Format(time.RFC3339),
+			strconv.FormatFloat(s.NowPower, 'f', -1, 64),
+			strconv.FormatFloat(s.NowCurrent, 'f', -1, 64),
+			strconv.FormatFloat(s.DailyEnergy, 'f', -1, 64),
+			strconv.FormatFloat(s.WeeklyEnergy, 'f', -1, 64),
+			strconv.FormatFloat(s.MonthlyEnergy, 'f', -1, 64),
+			strconv.FormatFloat(s.SessionEnergy, 'f', -1, 64),
+		})
+	}
+}
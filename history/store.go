@@ -0,0 +1,102 @@
+// Package history persists plug readings to an embedded BoltDB
+// database, giving users durable long-term history independent of
+// whether a Prometheus server happens to be scraping at any given
+// moment.
+package history
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Sample is a single point-in-time snapshot of a plug's readings
+type Sample struct {
+	Timestamp     time.Time `json:"timestamp"`
+	NowPower      float64   `json:"now_power"`
+	NowCurrent    float64   `json:"now_current"`
+	DailyEnergy   float64   `json:"daily_energy"`
+	WeeklyEnergy  float64   `json:"weekly_energy"`
+	MonthlyEnergy float64   `json:"monthly_energy"`
+	SessionEnergy float64   `json:"session_energy"`
+}
+
+// Store is an embedded, append-only time-series store keyed by the
+// plug's friendly system name (the same name used in MQTT topics,
+// /discovery labels and /rules), bucketed so each plug's samples sort
+// by timestamp
+type Store struct {
+	db *bolt.DB
+}
+
+// Open opens (creating if necessary) the BoltDB file at path
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Store{db: db}, nil
+}
+
+// Close releases the underlying database file
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Record appends a sample for the given plug (identified by its
+// system name)
+func (s *Store) Record(systemName string, sample Sample) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(systemName))
+		if err != nil {
+			return err
+		}
+
+		payload, err := json.Marshal(sample)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put(timeKey(sample.Timestamp), payload)
+	})
+}
+
+// Query returns every sample recorded for the given plug between from
+// and to (inclusive)
+func (s *Store) Query(systemName string, from, to time.Time) ([]Sample, error) {
+	var samples []Sample
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(systemName))
+		if bucket == nil {
+			return nil
+		}
+
+		c := bucket.Cursor()
+		min := timeKey(from)
+		max := timeKey(to)
+
+		for k, v := c.Seek(min); k != nil && string(k) <= string(max); k, v = c.Next() {
+			var sample Sample
+			if err := json.Unmarshal(v, &sample); err != nil {
+				return err
+			}
+			samples = append(samples, sample)
+		}
+
+		return nil
+	})
+
+	return samples, err
+}
+
+// timeKey encodes a timestamp as a big-endian byte slice so BoltDB's
+// natural byte-order key sort doubles as chronological order
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
@@ -1,46 +1,73 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"reflect"
 	"time"
 
 	"github.com/Luzifer/ediplug_ctrl/ediplug"
+	"github.com/Luzifer/ediplug_ctrl/ediplug/discovery"
+	"github.com/Luzifer/ediplug_ctrl/history"
+	"github.com/Luzifer/ediplug_ctrl/mqtt"
+	"github.com/Luzifer/ediplug_ctrl/scheduler"
 	"github.com/Luzifer/rconfig"
 	"github.com/cenkalti/backoff"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/robfig/cron"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
 	cfg = struct {
-		ShowVersion  bool     `flag:"version" default:"false" description:"Show version and exit"`
-		PlugIPs      []string `flag:"ip" default:"" description:"IPs of plugs to monitor / control"`
-		PollInterval int      `flag:"poll" default:"10" description:"Poll every N seconds"`
-		PlugPassword string   `flag:"password" default:"1234" description:"Password of the plugs"`
-		Listen       string   `flag:"listen" default:":3000" description:"Address to listen on for HTTP interface"`
+		ShowVersion       bool          `flag:"version" default:"false" description:"Show version and exit"`
+		ConfigFile        string        `flag:"config" default:"config.yaml" description:"Path to YAML file defining modules (per-plug password / labels)"`
+		Listen            string        `flag:"listen" default:":3000" description:"Address to listen on for HTTP interface"`
+		Discovery         bool          `flag:"discovery" default:"false" description:"Auto-discover plugs on the network via SSDP"`
+		DiscoveryInterval time.Duration `flag:"discovery-interval" default:"5m" description:"How often to re-run the SSDP discovery sweep"`
+		DiscoveryPassword string        `flag:"discovery-password" default:"1234" description:"Password used to confirm discovered plugs"`
+		RulesFile         string        `flag:"rules" default:"rules.yaml" description:"Path to YAML file defining scheduler rules"`
+		Collectors        []string      `flag:"collectors" default:"" description:"Collectors to run by default when a module doesn't set its own (default: system-info,state,energy)"`
+		HistoryDB         string        `flag:"history-db" default:"" description:"Path to a BoltDB file to record long-term history in (disabled if empty)"`
+		HistoryInterval   time.Duration `flag:"history-poll" default:"60s" description:"How often to snapshot plugs into the history store"`
+		MQTTBroker        string        `flag:"mqtt-broker" default:"" description:"MQTT broker URL to bridge plug state to, e.g. tcp://localhost:1883"`
+		MQTTTopicPrefix   string        `flag:"mqtt-topic-prefix" default:"ediplug" description:"Topic prefix to publish plug state/energy under"`
+		MQTTPollInterval  time.Duration `flag:"mqtt-poll" default:"10s" description:"How often to poll plugs for the MQTT bridge"`
 	}{}
 
 	version = "dev"
 
-	metrics = map[string]plugMetrics{}
-	plugs   = map[string]string{}
+	modules = newConfigStore()
+
+	discoverer *discovery.Discoverer
+	sched      *scheduler.Scheduler
 
 	defaultBackoff = backoff.NewExponentialBackOff()
-)
 
-type plugMetrics struct {
-	Activated     prometheus.Gauge
-	NowCurrent    prometheus.Gauge
-	NowPower      prometheus.Gauge
-	DailyEnergy   prometheus.Gauge
-	WeeklyEnergy  prometheus.Gauge
-	MonthlyEnergy prometheus.Gauge
-}
+	selfMetrics = struct {
+		ScrapeDuration *prometheus.HistogramVec
+		ScrapesTotal   *prometheus.CounterVec
+		ScrapeErrors   *prometheus.CounterVec
+	}{
+		ScrapeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "ediplug_exporter",
+			Name:      "scrape_duration_seconds",
+			Help:      "Time it took to probe a single target",
+		}, []string{"target"}),
+		ScrapesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ediplug_exporter",
+			Name:      "scrapes_total",
+			Help:      "Number of probes executed for a target",
+		}, []string{"target"}),
+		ScrapeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ediplug_exporter",
+			Name:      "scrape_errors_total",
+			Help:      "Number of probes for a target which failed",
+		}, []string{"target"}),
+	}
+)
 
 func init() {
 	rconfig.Parse(&cfg)
@@ -50,137 +77,244 @@ func init() {
 		os.Exit(0)
 	}
 
-	if len(cfg.PlugIPs) == 0 || reflect.DeepEqual(cfg.PlugIPs, []string{""}) {
-		rconfig.Usage()
-		os.Exit(0)
-	}
-
 	defaultBackoff.MaxElapsedTime = 5 * time.Second
+
+	prometheus.MustRegister(selfMetrics.ScrapeDuration)
+	prometheus.MustRegister(selfMetrics.ScrapesTotal)
+	prometheus.MustRegister(selfMetrics.ScrapeErrors)
 }
 
 func main() {
-	for _, plugIP := range cfg.PlugIPs {
-		c := &ediplug.GetSystemInfoCommand{}
-		if err := backoff.Retry(func() error {
-			return ediplug.ExecuteCommand(c, plugIP, cfg.PlugPassword)
-		}, defaultBackoff); err != nil {
-			log.Printf("Unable to fetch system information for plug '%s', not fetching data.", plugIP)
-			continue
+	if err := watchConfig(cfg.ConfigFile, modules); err != nil {
+		log.Printf("Unable to load config file '%s', continuing with defaults: %s", cfg.ConfigFile, err)
+	}
+
+	if cfg.Discovery {
+		discoverer = discovery.New(cfg.DiscoveryPassword, cfg.DiscoveryInterval)
+		discoverer.Start()
+	}
+
+	if s, err := loadScheduler(cfg.RulesFile); err != nil {
+		log.Printf("Unable to load rules file '%s', scheduler disabled: %s", cfg.RulesFile, err)
+	} else {
+		sched = s
+		sched.Start()
+	}
+
+	if cfg.MQTTBroker != "" {
+		targetsFunc := func() []mqtt.Target {
+			resolved := modules.ResolvedTargets()
+			targets := make([]mqtt.Target, 0, len(resolved))
+			for _, t := range resolved {
+				targets = append(targets, mqtt.Target{IP: t.IP, Password: t.Module.Password})
+			}
+			return targets
 		}
 
-		commonLabels := prometheus.Labels{
-			"system_name":      c.SystemName,
-			"mac_address":      c.MacAddress,
-			"firmware_version": c.FirmwareVersion,
-			"model":            c.Model,
+		bridge, err := mqtt.New(cfg.MQTTBroker, cfg.MQTTTopicPrefix, cfg.MQTTPollInterval, targetsFunc)
+		if err != nil {
+			log.Printf("Unable to connect to MQTT broker '%s', MQTT bridge disabled: %s", cfg.MQTTBroker, err)
+		} else {
+			bridge.Start()
 		}
+	}
 
-		plugs[c.SystemName] = plugIP
-		metrics[plugIP] = plugMetrics{
-			Activated: prometheus.NewGauge(prometheus.GaugeOpts{
-				Namespace:   "ediplug",
-				Name:        "activated",
-				Help:        "0 if switched off, 1 if switched on",
-				ConstLabels: commonLabels,
-			}),
-			NowCurrent: prometheus.NewGauge(prometheus.GaugeOpts{
-				Namespace:   "ediplug",
-				Name:        "now_current",
-				Help:        "Current in Ampere fetched last iteration",
-				ConstLabels: commonLabels,
-			}),
-			NowPower: prometheus.NewGauge(prometheus.GaugeOpts{
-				Namespace:   "ediplug",
-				Name:        "now_power",
-				Help:        "Power in Watt fetched last iteration",
-				ConstLabels: commonLabels,
-			}),
-			DailyEnergy: prometheus.NewGauge(prometheus.GaugeOpts{
-				Namespace:   "ediplug",
-				Name:        "daily_energy",
-				Help:        "Energy used within last day, measured in kWh",
-				ConstLabels: commonLabels,
-			}),
-			WeeklyEnergy: prometheus.NewGauge(prometheus.GaugeOpts{
-				Namespace:   "ediplug",
-				Name:        "weekly_energy",
-				Help:        "Energy used within last week, measured in kWh",
-				ConstLabels: commonLabels,
-			}),
-			MonthlyEnergy: prometheus.NewGauge(prometheus.GaugeOpts{
-				Namespace:   "ediplug",
-				Name:        "monthly_energy",
-				Help:        "Energy used within last month, measured in kWh",
-				ConstLabels: commonLabels,
-			}),
+	var historyStore *history.Store
+	if cfg.HistoryDB != "" {
+		hs, err := history.Open(cfg.HistoryDB)
+		if err != nil {
+			log.Printf("Unable to open history store '%s', history disabled: %s", cfg.HistoryDB, err)
+		} else {
+			historyStore = hs
+			go runHistoryPoller(historyStore, cfg.HistoryInterval)
 		}
+	}
 
-		prometheus.MustRegister(metrics[plugIP].Activated)
-		prometheus.MustRegister(metrics[plugIP].DailyEnergy)
-		prometheus.MustRegister(metrics[plugIP].MonthlyEnergy)
-		prometheus.MustRegister(metrics[plugIP].NowCurrent)
-		prometheus.MustRegister(metrics[plugIP].NowPower)
-		prometheus.MustRegister(metrics[plugIP].WeeklyEnergy)
+	r := mux.NewRouter()
+	r.Handle("/metrics", promhttp.Handler())
+	r.HandleFunc("/probe", handleProbe)
+	r.HandleFunc("/discovery", handleDiscovery)
+	r.HandleFunc("/switch/{target}/{state}", handlePlugSwitch)
+	r.HandleFunc("/rules", handleRulesList).Methods("GET")
+	r.HandleFunc("/rules/{name}/enable", handleRuleSetEnabled(true)).Methods("POST")
+	r.HandleFunc("/rules/{name}/disable", handleRuleSetEnabled(false)).Methods("POST")
+	r.HandleFunc("/history", handleHistory(historyStore)).Methods("GET")
+	http.ListenAndServe(cfg.Listen, r)
+}
+
+// httpSDResponse is a single entry of the Prometheus http_sd_config format
+type httpSDResponse struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// handleDiscovery serves the currently known, confirmed plugs in the
+// format expected by a Prometheus http_sd_config, so a multi-target
+// deployment can be driven purely from discovery results
+func handleDiscovery(res http.ResponseWriter, r *http.Request) {
+	if discoverer == nil {
+		res.Header().Set("Content-Type", "application/json")
+		res.Write([]byte("[]"))
+		return
+	}
+
+	targets := discoverer.Targets()
+	out := make([]httpSDResponse, 0, len(targets))
+	for _, t := range targets {
+		out = append(out, httpSDResponse{
+			Targets: []string{t.HTTPSDTarget()},
+			Labels: map[string]string{
+				"system_name": t.SystemName,
+				"mac_address": t.MacAddress,
+			},
+		})
 	}
 
-	fetchMetrics()
+	res.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(out); err != nil {
+		http.Error(res, fmt.Sprintf("unable to encode discovery response: %s", err), http.StatusInternalServerError)
+	}
+}
 
-	c := cron.New()
-	c.AddFunc(fmt.Sprintf("@every %ds", cfg.PollInterval), fetchMetrics)
-	c.Start()
+// handleProbe implements the multi-target exporter pattern: every
+// request gets a fresh prometheus.Registry populated only with the
+// data collected for this single target, so Prometheus (not us) is in
+// control of the scrape cadence per plug.
+func handleProbe(res http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(res, "target parameter is required", http.StatusBadRequest)
+		return
+	}
 
-	r := mux.NewRouter()
-	r.Handle("/metrics", prometheus.Handler())
-	r.HandleFunc("/switch/{system}/{state}", handlePlugSwitch)
-	http.ListenAndServe(cfg.Listen, r)
+	module := modules.moduleFor(r.URL.Query().Get("module"))
+
+	start := time.Now()
+	registry := prometheus.NewRegistry()
+
+	err := probeTarget(registry, target, module)
+
+	selfMetrics.ScrapeDuration.WithLabelValues(target).Observe(time.Since(start).Seconds())
+	selfMetrics.ScrapesTotal.WithLabelValues(target).Inc()
+	if err != nil {
+		selfMetrics.ScrapeErrors.WithLabelValues(target).Inc()
+		if discoverer != nil {
+			discoverer.RecordFailure(target)
+		}
+		http.Error(res, fmt.Sprintf("probe failed: %s", err), http.StatusServiceUnavailable)
+		return
+	}
+
+	if discoverer != nil {
+		discoverer.RecordSuccess(target)
+	}
+
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(res, r)
 }
 
-func fetchMetrics() {
-	for i := range cfg.PlugIPs {
-		go func(plugIP string) {
-			ce := &ediplug.GetEnergyCommand{}
+// collectedMetrics is a static prometheus.Collector wrapping metrics
+// already gathered from a plug, so they can be registered on a
+// per-request registry without re-running Collect on every /metrics scrape
+type collectedMetrics struct {
+	descs   []*prometheus.Desc
+	metrics []prometheus.Metric
+}
 
-			if err := backoff.Retry(func() error {
-				return ediplug.ExecuteCommand(ce, plugIP, cfg.PlugPassword)
-			}, defaultBackoff); err != nil {
-				log.Printf("Unable to fetch metrics for plug '%s'", plugIP)
-				return
-			}
+func (c *collectedMetrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range c.descs {
+		ch <- d
+	}
+}
 
-			metrics[plugIP].DailyEnergy.Set(ce.DailyEnergy)
-			metrics[plugIP].MonthlyEnergy.Set(ce.MonthlyEnergy)
-			metrics[plugIP].NowCurrent.Set(ce.NowCurrent)
-			metrics[plugIP].NowPower.Set(ce.NowPower)
-			metrics[plugIP].WeeklyEnergy.Set(ce.WeeklyEnergy)
-
-			ca := &ediplug.GetStateCommand{}
-			if err := backoff.Retry(func() error {
-				return ediplug.ExecuteCommand(ca, plugIP, cfg.PlugPassword)
-			}, defaultBackoff); err != nil {
-				log.Printf("Unable to fetch acivation status for plug '%s'", plugIP)
-				return
-			}
+func (c *collectedMetrics) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c.metrics {
+		ch <- m
+	}
+}
 
-			switch ca.CurrentState {
-			case "ON":
-				metrics[plugIP].Activated.Set(1)
-			case "OFF":
-				metrics[plugIP].Activated.Set(0)
-			default:
-				log.Printf("Got unexpected activation status for plug '%s': %s", plugIP, ca.CurrentState)
-			}
-		}(cfg.PlugIPs[i])
+// collectorNamesFor resolves which collectors to run for a probe: a
+// module's own `collectors` list wins, then --collectors, then ediplug's
+// built-in default set
+func collectorNamesFor(module *Module) []string {
+	switch {
+	case len(module.Collectors) > 0:
+		return module.Collectors
+	case len(cfg.Collectors) > 0:
+		return cfg.Collectors
+	default:
+		return ediplug.DefaultCollectorNames
+	}
+}
+
+// probeTarget fetches system info and then runs every configured
+// collector for the plug, registering the resulting metrics on the
+// given (per-request) registry.
+func probeTarget(registry *prometheus.Registry, target string, module *Module) error {
+	plugBackoff := backoff.NewExponentialBackOff()
+	plugBackoff.MaxElapsedTime = module.Timeout
+
+	si := &ediplug.GetSystemInfoCommand{}
+	if err := backoff.Retry(func() error {
+		return ediplug.ExecuteCommand(si, target, module.Password)
+	}, plugBackoff); err != nil {
+		return fmt.Errorf("fetching system information: %s", err)
+	}
+
+	commonLabels := prometheus.Labels{
+		"system_name":      si.SystemName,
+		"mac_address":      si.MacAddress,
+		"firmware_version": si.FirmwareVersion,
+		"model":            si.Model,
+	}
+	for k, v := range module.Labels {
+		commonLabels[k] = v
+	}
+
+	collected := &collectedMetrics{}
+
+	for _, name := range collectorNamesFor(module) {
+		c, err := ediplug.NewCollector(name, target, module.Password, si, commonLabels)
+		if err != nil {
+			return fmt.Errorf("building collector %q: %s", name, err)
+		}
+
+		descCh := make(chan *prometheus.Desc, 8)
+		go func() {
+			c.Describe(descCh)
+			close(descCh)
+		}()
+		for d := range descCh {
+			collected.descs = append(collected.descs, d)
+		}
+
+		metricCh := make(chan prometheus.Metric, 8)
+		collectErr := make(chan error, 1)
+		go func() {
+			collectErr <- backoff.Retry(func() error {
+				return c.Collect(metricCh)
+			}, plugBackoff)
+			close(metricCh)
+		}()
+		for m := range metricCh {
+			collected.metrics = append(collected.metrics, m)
+		}
+		if err := <-collectErr; err != nil {
+			return fmt.Errorf("collector %q: %s", name, err)
+		}
 	}
+
+	registry.MustRegister(collected)
+
+	return nil
 }
 
+// handlePlugSwitch switches a plug on or off. Unlike /probe this does
+// not require a module to already know the target's system name, the
+// target IP/host is passed directly in the URL.
 func handlePlugSwitch(res http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	ip, ok := plugs[vars["system"]]
-	if !ok {
-		http.Error(res, "Plug not found.", http.StatusNotFound)
-		return
-	}
+	module := modules.moduleFor(r.URL.Query().Get("module"))
 
 	stateRequest := &ediplug.SetStateCommand{}
 
@@ -195,7 +329,7 @@ func handlePlugSwitch(res http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := backoff.Retry(func() error {
-		return ediplug.ExecuteCommand(stateRequest, ip, cfg.PlugPassword)
+		return ediplug.ExecuteCommand(stateRequest, vars["target"], module.Password)
 	}, defaultBackoff); err != nil {
 		http.Error(res, fmt.Sprintf("An error occurred while setting state: %s", err), http.StatusInternalServerError)
 		return
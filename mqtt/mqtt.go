@@ -0,0 +1,282 @@
+// Package mqtt bridges plug state and energy readings to MQTT, with
+// Home Assistant MQTT Discovery so switch/sensor entities show up
+// automatically instead of needing manual HA configuration.
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/ediplug_ctrl/ediplug"
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Target is a single plug the bridge polls and publishes
+type Target struct {
+	IP       string
+	Password string
+}
+
+// Bridge polls a set of plugs on an interval and mirrors their state
+// to MQTT, acting on commands sent back over the `.../set` topic
+type Bridge struct {
+	client       paho.Client
+	prefix       string
+	pollInterval time.Duration
+	targetsFunc  func() []Target
+
+	mu            sync.RWMutex
+	targetsByName map[string]Target
+}
+
+// New connects to the given MQTT broker and returns a Bridge ready to
+// Start polling whatever targetsFunc returns. targetsFunc is called on
+// every poll iteration rather than once at construction time, so it's
+// safe to back it with a config store that's hot-reloaded (see
+// runHistoryPoller, which does the same against modules.ResolvedTargets).
+func New(broker, topicPrefix string, pollInterval time.Duration, targetsFunc func() []Target) (*Bridge, error) {
+	b := &Bridge{
+		prefix:        topicPrefix,
+		pollInterval:  pollInterval,
+		targetsFunc:   targetsFunc,
+		targetsByName: map[string]Target{},
+	}
+
+	opts := paho.NewClientOptions().
+		AddBroker(broker).
+		SetClientID("ediplug_ctrl").
+		SetWill(b.topic("bridge/status"), "offline", 1, true).
+		SetOnConnectHandler(b.onConnect)
+
+	b.client = paho.NewClient(opts)
+	if token := b.client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+
+	return b, nil
+}
+
+// Start launches the periodic poll loop and publishes the initial
+// Home Assistant discovery messages. It returns immediately.
+func (b *Bridge) Start() {
+	go func() {
+		for {
+			b.pollAll()
+			time.Sleep(b.pollInterval)
+		}
+	}()
+}
+
+func (b *Bridge) topic(parts ...string) string {
+	t := b.prefix
+	for _, p := range parts {
+		t = t + "/" + p
+	}
+	return t
+}
+
+// onConnect marks the bridge online and subscribes once to the
+// wildcard command topic shared by every plug - a single filter with a
+// topic-aware handler, since paho's router keeps only the last
+// callback registered for a given filter and would otherwise silently
+// drop all but one target's subscription
+func (b *Bridge) onConnect(client paho.Client) {
+	client.Publish(b.topic("bridge/status"), 1, true, "online")
+
+	topic := fmt.Sprintf("%s/+/set", b.prefix)
+	client.Subscribe(topic, 1, b.handleSet)
+}
+
+// handleSet reacts to a `.../set` message by switching the plug named
+// in the message's topic, resolved against the plugs seen so far by pollOne
+func (b *Bridge) handleSet(c paho.Client, m paho.Message) {
+	systemName := systemNameFromSetTopic(b.prefix, m.Topic())
+	if systemName == "" {
+		log.Printf("MQTT: unable to parse system name from topic '%s'", m.Topic())
+		return
+	}
+
+	b.mu.RLock()
+	t, ok := b.targetsByName[systemName]
+	b.mu.RUnlock()
+	if !ok {
+		log.Printf("MQTT: received set for unknown plug '%s'", systemName)
+		return
+	}
+
+	state := string(m.Payload())
+
+	cmd := &ediplug.SetStateCommand{DesiredState: state}
+	if err := ediplug.ExecuteCommand(cmd, t.IP, t.Password); err != nil {
+		log.Printf("MQTT: unable to set state for plug '%s': %s", systemName, err)
+	}
+}
+
+// systemNameFromSetTopic extracts "<system>" out of "<prefix>/<system>/set",
+// returning "" if topic doesn't match that shape under prefix
+func systemNameFromSetTopic(prefix, topic string) string {
+	rest := strings.TrimPrefix(topic, prefix+"/")
+	if rest == topic || !strings.HasSuffix(rest, "/set") {
+		return ""
+	}
+
+	return strings.TrimSuffix(rest, "/set")
+}
+
+// pollAll probes every currently configured target once and publishes
+// its current state
+func (b *Bridge) pollAll() {
+	for _, t := range b.targetsFunc() {
+		if err := b.pollOne(t); err != nil {
+			log.Printf("MQTT: unable to poll plug '%s': %s", t.IP, err)
+		}
+	}
+}
+
+func (b *Bridge) pollOne(t Target) error {
+	si := &ediplug.GetSystemInfoCommand{}
+	if err := ediplug.ExecuteCommand(si, t.IP, t.Password); err != nil {
+		b.publishAvailability(t.IP, false)
+		return err
+	}
+
+	b.mu.Lock()
+	b.targetsByName[si.SystemName] = t
+	b.mu.Unlock()
+
+	cs := &ediplug.GetStateCommand{}
+	if err := ediplug.ExecuteCommand(cs, t.IP, t.Password); err != nil {
+		b.publishAvailability(si.SystemName, false)
+		return err
+	}
+
+	b.publishDiscovery(si)
+	b.publishAvailability(si.SystemName, true)
+
+	base := b.topic(si.SystemName)
+	b.client.Publish(base+"/state", 0, true, cs.CurrentState)
+
+	// Older SP-1101W firmware has no energy metering hardware at all;
+	// GetEnergyCommand.Parse hard-fails on its empty LastToggleTime, so
+	// skip it rather than letting that void the whole poll cycle.
+	if ediplug.SupportsEnergy(si.Model) {
+		ce := &ediplug.GetEnergyCommand{}
+		if err := ediplug.ExecuteCommand(ce, t.IP, t.Password); err != nil {
+			return err
+		}
+
+		b.client.Publish(base+"/power", 0, true, fmt.Sprintf("%.2f", ce.NowPower))
+		b.client.Publish(base+"/energy/day", 0, true, fmt.Sprintf("%.3f", ce.DailyEnergy))
+		b.client.Publish(base+"/energy/week", 0, true, fmt.Sprintf("%.3f", ce.WeeklyEnergy))
+		b.client.Publish(base+"/energy/month", 0, true, fmt.Sprintf("%.3f", ce.MonthlyEnergy))
+	}
+
+	return nil
+}
+
+func (b *Bridge) publishAvailability(systemName string, available bool) {
+	payload := "offline"
+	if available {
+		payload = "online"
+	}
+	b.client.Publish(b.topic(systemName, "availability"), 0, true, payload)
+}
+
+// haDevice is the shared "device" block referenced by every entity's
+// discovery config, so Home Assistant groups them under one device
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Model        string   `json:"model"`
+	SWVersion    string   `json:"sw_version"`
+	Manufacturer string   `json:"manufacturer"`
+}
+
+type haSwitchConfig struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	CommandTopic      string   `json:"command_topic"`
+	StateTopic        string   `json:"state_topic"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	PayloadOn         string   `json:"payload_on"`
+	PayloadOff        string   `json:"payload_off"`
+	Device            haDevice `json:"device"`
+}
+
+type haSensorConfig struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	StateTopic        string   `json:"state_topic"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	UnitOfMeasurement string   `json:"unit_of_measurement"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	Device            haDevice `json:"device"`
+}
+
+// publishDiscovery publishes the retained Home Assistant MQTT
+// Discovery config for the switch and every sensor of a plug. HA
+// deduplicates on unique_id, so it's safe (and necessary, since
+// firmware version etc. can change) to publish this on every poll.
+func (b *Bridge) publishDiscovery(si *ediplug.GetSystemInfoCommand) {
+	device := haDevice{
+		Identifiers:  []string{si.MacAddress},
+		Name:         si.SystemName,
+		Model:        si.Model,
+		SWVersion:    si.FirmwareVersion,
+		Manufacturer: "Edimax",
+	}
+
+	availabilityTopic := b.topic(si.SystemName, "availability")
+
+	sw := haSwitchConfig{
+		Name:              si.SystemName,
+		UniqueID:          si.MacAddress,
+		CommandTopic:      b.topic(si.SystemName, "set"),
+		StateTopic:        b.topic(si.SystemName, "state"),
+		AvailabilityTopic: availabilityTopic,
+		PayloadOn:         "ON",
+		PayloadOff:        "OFF",
+		Device:            device,
+	}
+	b.publishHAConfig("switch", si.MacAddress, sw)
+
+	sensors := []struct {
+		suffix      string
+		stateSuffix string
+		unit        string
+		class       string
+	}{
+		{"power", "power", "W", "power"},
+		{"energy_day", "energy/day", "kWh", "energy"},
+		{"energy_week", "energy/week", "kWh", "energy"},
+		{"energy_month", "energy/month", "kWh", "energy"},
+	}
+
+	for _, s := range sensors {
+		cfg := haSensorConfig{
+			Name:              si.SystemName + " " + s.suffix,
+			UniqueID:          si.MacAddress + "_" + s.suffix,
+			StateTopic:        b.topic(si.SystemName, s.stateSuffix),
+			AvailabilityTopic: availabilityTopic,
+			UnitOfMeasurement: s.unit,
+			DeviceClass:       s.class,
+			Device:            device,
+		}
+		b.publishHAConfig("sensor", si.MacAddress+"_"+s.suffix, cfg)
+	}
+}
+
+func (b *Bridge) publishHAConfig(component, objectID string, cfg interface{}) {
+	payload, err := json.Marshal(cfg)
+	if err != nil {
+		log.Printf("MQTT: unable to marshal discovery config for %s/%s: %s", component, objectID, err)
+		return
+	}
+
+	topic := fmt.Sprintf("homeassistant/%s/%s/config", component, objectID)
+	b.client.Publish(topic, 1, true, payload)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/Luzifer/ediplug_ctrl/scheduler"
+	"github.com/gorilla/mux"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// loadScheduler reads the scheduler rule file and builds a
+// scheduler.Scheduler from it. A missing file is not an error: the
+// scheduler subsystem is optional.
+func loadScheduler(path string) (*scheduler.Scheduler, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := scheduler.Config{}
+	if err := yaml.Unmarshal(raw, &cfg); err != nil {
+		return nil, err
+	}
+
+	return scheduler.New(cfg), nil
+}
+
+// ruleResponse is the JSON representation of a single rule served by /rules
+type ruleResponse struct {
+	Name     string     `json:"name"`
+	Kind     string     `json:"kind"`
+	Target   string     `json:"target"`
+	Enabled  bool       `json:"enabled"`
+	LastFire *time.Time `json:"last_fire,omitempty"`
+}
+
+// handleRulesList lists all configured rules and their current state
+func handleRulesList(res http.ResponseWriter, r *http.Request) {
+	if sched == nil {
+		json.NewEncoder(res).Encode([]ruleResponse{})
+		return
+	}
+
+	out := make([]ruleResponse, 0, len(sched.Rules()))
+	for _, rule := range sched.Rules() {
+		var lastFire *time.Time
+		if lf := rule.LastFire(); !lf.IsZero() {
+			lastFire = &lf
+		}
+
+		out = append(out, ruleResponse{
+			Name:     rule.Config.Name,
+			Kind:     string(rule.Config.Kind()),
+			Target:   rule.Config.Target,
+			Enabled:  rule.Enabled(),
+			LastFire: lastFire,
+		})
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(out)
+}
+
+// handleRuleSetEnabled enables or disables a single rule by name
+func handleRuleSetEnabled(enabled bool) http.HandlerFunc {
+	return func(res http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+
+		if sched == nil {
+			http.Error(res, "no rules configured", http.StatusNotFound)
+			return
+		}
+
+		for _, rule := range sched.Rules() {
+			if rule.Config.Name == name {
+				rule.SetEnabled(enabled)
+				http.Error(res, "OK", http.StatusOK)
+				return
+			}
+		}
+
+		http.Error(res, "rule not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,292 @@
+// Package scheduler turns ediplug_ctrl into a small control plane on
+// top of the plain exporter: it evaluates cron, sunrise/sunset and
+// power-threshold rules and drives ediplug.SetStateCommand directly,
+// without needing an external automation system.
+package scheduler
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/ediplug_ctrl/ediplug"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robfig/cron"
+)
+
+// thresholdPollInterval is how often threshold rules re-check the
+// plug's current power draw
+const thresholdPollInterval = 30 * time.Second
+
+var (
+	metricRuleActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ediplug",
+		Name:      "rule_active",
+		Help:      "1 if the rule is currently enabled, 0 otherwise",
+	}, []string{"rule"})
+
+	metricRuleLastFire = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ediplug",
+		Name:      "rule_last_fire_timestamp",
+		Help:      "Unix timestamp of the last time the rule fired",
+	}, []string{"rule"})
+)
+
+func init() {
+	prometheus.MustRegister(metricRuleActive)
+	prometheus.MustRegister(metricRuleLastFire)
+}
+
+// Config is the YAML-loadable configuration for the whole scheduler
+type Config struct {
+	Latitude  float64      `yaml:"latitude"`
+	Longitude float64      `yaml:"longitude"`
+	Rules     []RuleConfig `yaml:"rules"`
+}
+
+// RuleConfig describes a single rule. Only the fields relevant to the
+// rule's Kind need to be set; which Kind a rule has is derived from
+// which of Cron / Sun / Metric is present.
+type RuleConfig struct {
+	Name     string `yaml:"name"`
+	Target   string `yaml:"target"`
+	Password string `yaml:"password"`
+	Enabled  bool   `yaml:"enabled"`
+
+	// Cron rules: fire State at Target on the given cron expression
+	Cron  string `yaml:"cron"`
+	State string `yaml:"state"`
+
+	// Sun rules: fire State at sunrise/sunset (+/- Offset)
+	Sun    string        `yaml:"sun"` // "sunrise" or "sunset"
+	Offset time.Duration `yaml:"offset"`
+
+	// Threshold rules: fire State once Metric stays below Below for Sustained
+	Metric    string        `yaml:"metric"` // currently only "now_power"
+	Below     float64       `yaml:"below"`
+	Sustained time.Duration `yaml:"sustained"`
+}
+
+// Kind identifies which of the three rule flavors a RuleConfig describes
+type Kind string
+
+const (
+	// KindCron fires on a cron schedule
+	KindCron Kind = "cron"
+	// KindSun fires relative to sunrise/sunset
+	KindSun Kind = "sun"
+	// KindThreshold fires once a metric stays below a bound for a duration
+	KindThreshold Kind = "threshold"
+)
+
+// Kind returns which flavor of rule this config describes
+func (r RuleConfig) Kind() Kind {
+	switch {
+	case r.Cron != "":
+		return KindCron
+	case r.Sun != "":
+		return KindSun
+	default:
+		return KindThreshold
+	}
+}
+
+// Rule is the runtime state of a single configured rule
+type Rule struct {
+	Config RuleConfig
+
+	mu       sync.Mutex
+	enabled  bool
+	lastFire time.Time
+
+	belowSince time.Time
+}
+
+// Enabled reports whether the rule is currently active
+func (r *Rule) Enabled() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.enabled
+}
+
+// SetEnabled enables or disables the rule
+func (r *Rule) SetEnabled(enabled bool) {
+	r.mu.Lock()
+	r.enabled = enabled
+	r.mu.Unlock()
+
+	v := 0.0
+	if enabled {
+		v = 1.0
+	}
+	metricRuleActive.WithLabelValues(r.Config.Name).Set(v)
+}
+
+// LastFire returns the last time the rule fired, or the zero time if
+// it never did
+func (r *Rule) LastFire() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastFire
+}
+
+func (r *Rule) recordFire() {
+	now := time.Now()
+
+	r.mu.Lock()
+	r.lastFire = now
+	r.mu.Unlock()
+
+	metricRuleLastFire.WithLabelValues(r.Config.Name).Set(float64(now.Unix()))
+}
+
+// Scheduler evaluates and fires all configured rules
+type Scheduler struct {
+	cfg   Config
+	cron  *cron.Cron
+	rules []*Rule
+}
+
+// New creates a Scheduler from the given configuration. Call Start to
+// actually begin evaluating rules.
+func New(cfg Config) *Scheduler {
+	s := &Scheduler{
+		cfg:  cfg,
+		cron: cron.New(),
+	}
+
+	for _, rc := range cfg.Rules {
+		r := &Rule{Config: rc, enabled: rc.Enabled}
+		s.rules = append(s.rules, r)
+	}
+
+	return s
+}
+
+// Rules returns all configured rules, in the order they were declared
+func (s *Scheduler) Rules() []*Rule {
+	return s.rules
+}
+
+// Start begins evaluating every configured rule in the background
+func (s *Scheduler) Start() {
+	for _, r := range s.rules {
+		r.SetEnabled(r.Enabled())
+
+		switch r.Config.Kind() {
+		case KindCron:
+			s.scheduleCron(r)
+		case KindSun:
+			s.scheduleSun(r)
+		case KindThreshold:
+			s.scheduleThreshold(r)
+		}
+	}
+
+	s.cron.Start()
+}
+
+func (s *Scheduler) scheduleCron(r *Rule) {
+	expr := r.Config.Cron
+	if err := s.cron.AddFunc(expr, func() {
+		s.fire(r, r.Config.State)
+	}); err != nil {
+		log.Printf("Scheduler: invalid cron expression for rule '%s': %s", r.Config.Name, err)
+	}
+}
+
+// scheduleSun recomputes today's sunrise/sunset once a day and arms a
+// timer for the (offset-adjusted) event
+func (s *Scheduler) scheduleSun(r *Rule) {
+	var arm func()
+	arm = func() {
+		sunrise, sunset := sunTimes(time.Now(), s.cfg.Latitude, s.cfg.Longitude)
+
+		fireAt := sunrise
+		if r.Config.Sun == "sunset" {
+			fireAt = sunset
+		}
+		fireAt = fireAt.Add(r.Config.Offset)
+
+		if fireAt.Before(time.Now()) {
+			fireAt = fireAt.Add(24 * time.Hour)
+		}
+
+		time.AfterFunc(time.Until(fireAt), func() {
+			s.fire(r, r.Config.State)
+			arm()
+		})
+	}
+
+	arm()
+}
+
+// scheduleThreshold polls the plug's current power draw and fires
+// once it has stayed below the configured bound for Sustained
+func (s *Scheduler) scheduleThreshold(r *Rule) {
+	go func() {
+		for {
+			time.Sleep(thresholdPollInterval)
+
+			if !r.Enabled() {
+				continue
+			}
+
+			power, err := currentMetric(r.Config)
+			if err != nil {
+				log.Printf("Scheduler: unable to evaluate threshold rule '%s': %s", r.Config.Name, err)
+				continue
+			}
+
+			r.mu.Lock()
+			if power < r.Config.Below {
+				if r.belowSince.IsZero() {
+					r.belowSince = time.Now()
+				}
+				sustainedFor := time.Since(r.belowSince)
+				shouldFire := sustainedFor >= r.Config.Sustained
+				r.mu.Unlock()
+
+				if shouldFire {
+					s.fire(r, r.Config.State)
+					r.mu.Lock()
+					r.belowSince = time.Time{}
+					r.mu.Unlock()
+				}
+			} else {
+				r.belowSince = time.Time{}
+				r.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// currentMetric fetches the metric value a threshold rule acts on
+func currentMetric(rc RuleConfig) (float64, error) {
+	switch rc.Metric {
+	case "", "now_power":
+		ce := &ediplug.GetEnergyCommand{}
+		if err := ediplug.ExecuteCommand(ce, rc.Target, rc.Password); err != nil {
+			return 0, err
+		}
+		return ce.NowPower, nil
+	default:
+		return 0, fmt.Errorf("unsupported metric %q", rc.Metric)
+	}
+}
+
+// fire executes the state change for a rule and records that it fired
+func (s *Scheduler) fire(r *Rule, state string) {
+	if !r.Enabled() {
+		return
+	}
+
+	c := &ediplug.SetStateCommand{DesiredState: state}
+	if err := ediplug.ExecuteCommand(c, r.Config.Target, r.Config.Password); err != nil {
+		log.Printf("Scheduler: rule '%s' failed to set state: %s", r.Config.Name, err)
+		return
+	}
+
+	r.recordFire()
+}
@@ -0,0 +1,42 @@
+package scheduler
+
+import (
+	"math"
+	"time"
+)
+
+// sunTimes computes the approximate sunrise and sunset time (UTC) for
+// the given date and position, using the standard NOAA solar
+// calculation. It is accurate to within a minute or two, which is
+// plenty for "turn the lights on around sunset" style rules.
+func sunTimes(day time.Time, latitude, longitude float64) (sunrise, sunset time.Time) {
+	rad := math.Pi / 180
+
+	year, month, date := day.Date()
+	n := day.YearDay()
+
+	// Fractional year, in radians
+	gamma := 2 * math.Pi / 365 * (float64(n) - 1)
+
+	eqTime := 229.18 * (0.000075 + 0.001868*math.Cos(gamma) - 0.032077*math.Sin(gamma) -
+		0.014615*math.Cos(2*gamma) - 0.040849*math.Sin(2*gamma))
+
+	decl := 0.006918 - 0.399912*math.Cos(gamma) + 0.070257*math.Sin(gamma) -
+		0.006758*math.Cos(2*gamma) + 0.000907*math.Sin(2*gamma) -
+		0.002697*math.Cos(3*gamma) + 0.00148*math.Sin(3*gamma)
+
+	latRad := latitude * rad
+
+	haArg := math.Cos(90.833*rad)/(math.Cos(latRad)*math.Cos(decl)) - math.Tan(latRad)*math.Tan(decl)
+	haArg = math.Max(-1, math.Min(1, haArg))
+	ha := math.Acos(haArg) / rad
+
+	sunriseMinutes := 720 - 4*(longitude+ha) - eqTime
+	sunsetMinutes := 720 - 4*(longitude-ha) - eqTime
+
+	base := time.Date(year, month, date, 0, 0, 0, 0, time.UTC)
+	sunrise = base.Add(time.Duration(sunriseMinutes * float64(time.Minute)))
+	sunset = base.Add(time.Duration(sunsetMinutes * float64(time.Minute)))
+
+	return sunrise, sunset
+}